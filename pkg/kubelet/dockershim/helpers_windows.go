@@ -20,8 +20,11 @@ limitations under the License.
 package dockershim
 
 import (
+	"fmt"
+	"net"
 	"os"
 	"runtime"
+	"strings"
 
 	"github.com/blang/semver"
 	dockertypes "github.com/docker/docker/api/types"
@@ -30,24 +33,145 @@ import (
 	"k8s.io/klog/v2"
 
 	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/kubernetes/pkg/util/osversion"
 )
 
+const (
+	// hostProcessAnnotation marks a sandbox or container as a Windows
+	// HostProcess workload. It predates a native HostProcess field on the
+	// CRI Windows security context types, so it's read off the sandbox and
+	// container annotations instead.
+	hostProcessAnnotation = "microsoft.com/hostprocess-container"
+
+	// hostProcessDefaultUser is the Windows account HostProcess containers
+	// run as when the pod spec doesn't set RunAsUsername explicitly.
+	hostProcessDefaultUser = `NT AUTHORITY\SYSTEM`
+
+	// isolationTypeAnnotation selects Windows container isolation ("process"
+	// or "hyperv") ahead of a native CRI field for it.
+	isolationTypeAnnotation = "experimental.windows.kubernetes.io/isolation-type"
+
+	// nanoCPUsHyperVMinBuild is the earliest build (between RS2 and RS3) that
+	// honors NanoCPUs for Hyper-V isolated containers; older hosts silently
+	// ignore the field, which is worse than failing loudly here.
+	nanoCPUsHyperVMinBuild = 16175
+
+	// credentialSpecSecurityOptPrefix is the docker HostConfig.SecurityOpt
+	// entry that carries a GMSA credential spec through to the Windows host.
+	credentialSpecSecurityOptPrefix = "credentialspec="
+
+	// containerAnnotationsLabelKeyPrefix is prepended to each CRI annotation
+	// key when updateCreateConfig stamps it onto the container's docker
+	// Labels, so the pair can be recovered later (e.g. in
+	// determinePodIPBySandboxID, which only has the inspected container's
+	// Labels to work with) without colliding with the io.kubernetes.* and
+	// sandboxIDLabelKey/containerTypeLabelKey bookkeeping labels the shim
+	// filters on elsewhere.
+	containerAnnotationsLabelKeyPrefix = "annotation."
+)
+
+// stampAnnotationsOnLabels copies annotations into labels under
+// containerAnnotationsLabelKeyPrefix, creating labels if it's nil. It
+// returns labels so callers can use it inline when building a docker
+// Config.Labels map from scratch.
+func stampAnnotationsOnLabels(labels map[string]string, annotations map[string]string) map[string]string {
+	if labels == nil {
+		labels = make(map[string]string, len(annotations))
+	}
+	for k, v := range annotations {
+		labels[containerAnnotationsLabelKeyPrefix+k] = v
+	}
+	return labels
+}
+
+// annotationsFromLabels recovers the CRI annotations a prior
+// stampAnnotationsOnLabels call stamped onto a container's docker Labels,
+// stripping the containerAnnotationsLabelKeyPrefix each one was stored
+// under.
+func annotationsFromLabels(labels map[string]string) map[string]string {
+	annotations := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if strings.HasPrefix(k, containerAnnotationsLabelKeyPrefix) {
+			annotations[strings.TrimPrefix(k, containerAnnotationsLabelKeyPrefix)] = v
+		}
+	}
+	return annotations
+}
+
+// credentialSpecSecurityOpt translates a GMSA CredentialSpec reference into
+// the docker HostConfig.SecurityOpt entry that carries it, validating that
+// the reference is one of the two forms docker understands. An empty
+// credentialSpec returns an empty securityOpt and no error.
+func credentialSpecSecurityOpt(credentialSpec string) (string, error) {
+	if credentialSpec == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(credentialSpec, "file://") && !strings.HasPrefix(credentialSpec, "registry://") {
+		return "", fmt.Errorf("credential spec %q must be a file:// or registry:// reference", credentialSpec)
+	}
+	return credentialSpecSecurityOptPrefix + credentialSpec, nil
+}
+
+// isolationTypeFor resolves the requested container isolation mode from
+// annotations, validating it against the host's Windows build. Hyper-V
+// isolation requires RS3 or later.
+func isolationTypeFor(annotations map[string]string) (dockercontainer.Isolation, error) {
+	switch annotations[isolationTypeAnnotation] {
+	case "":
+		return dockercontainer.IsolationDefault, nil
+	case "process":
+		return dockercontainer.IsolationProcess, nil
+	case "hyperv":
+		if osversion.Build() < osversion.RS3 {
+			return "", fmt.Errorf("hyperv isolation requires Windows build %d (RS3) or later, host is running build %d", osversion.RS3, osversion.Build())
+		}
+		return dockercontainer.IsolationHyperV, nil
+	default:
+		return "", fmt.Errorf("unsupported isolation type %q, must be one of: process, hyperv", annotations[isolationTypeAnnotation])
+	}
+}
+
+// isHostProcessContainer reports whether annotations mark their owning
+// sandbox or container as a Windows HostProcess workload.
+func isHostProcessContainer(annotations map[string]string) bool {
+	return annotations[hostProcessAnnotation] == "true"
+}
+
 // DefaultMemorySwap always returns 0 for no memory swap in a sandbox
 func DefaultMemorySwap() int64 {
 	return 0
 }
 
-func (ds *dockerService) getSecurityOpts(seccompProfile string, separator rune) ([]string, error) {
+// securityOptsFromCredentialSpec wraps a GMSA CredentialSpec reference into
+// the single-element SecurityOpt slice docker expects, shared by the
+// sandbox and container security-opt paths. HostProcess workloads share the
+// host's namespaces and so don't support GMSA, matching the rejection
+// applyWindowsContainerSecurityContext applies to the container path.
+func securityOptsFromCredentialSpec(credentialSpec string, hostProcess bool) ([]string, error) {
+	opt, err := credentialSpecSecurityOpt(credentialSpec)
+	if err != nil {
+		return nil, err
+	}
+	if opt == "" {
+		return nil, nil
+	}
+	if hostProcess {
+		return nil, fmt.Errorf("HostProcess containers do not support GMSA credential specs")
+	}
+	return []string{opt}, nil
+}
+
+func (ds *dockerService) getSecurityOpts(seccompProfile string, credentialSpec string, hostProcess bool, separator rune) ([]string, error) {
 	if seccompProfile != "" {
 		klog.InfoS("seccomp annotations are not supported on windows")
 	}
-	return nil, nil
+	return securityOptsFromCredentialSpec(credentialSpec, hostProcess)
 }
 
-func (ds *dockerService) getSandBoxSecurityOpts(separator rune) []string {
+func (ds *dockerService) getSandBoxSecurityOpts(credentialSpec string, hostProcess bool, separator rune) ([]string, error) {
 	// Currently, Windows container does not support privileged mode, so no no-new-privileges flag can be returned directly like Linux
 	// If the future Windows container has new support for privileged mode, we can adjust it here
-	return nil
+	return securityOptsFromCredentialSpec(credentialSpec, hostProcess)
 }
 
 func (ds *dockerService) updateCreateConfig(
@@ -55,6 +179,22 @@ func (ds *dockerService) updateCreateConfig(
 	config *runtimeapi.ContainerConfig,
 	sandboxConfig *runtimeapi.PodSandboxConfig,
 	podSandboxID string, securityOptSep rune, apiVersion *semver.Version) error {
+	sandboxHostProcess := isHostProcessContainer(sandboxConfig.GetAnnotations())
+	containerHostProcess := isHostProcessContainer(config.GetAnnotations())
+	if sandboxHostProcess != containerHostProcess {
+		return fmt.Errorf("pod sandbox and container disagree on HostProcess: sandbox=%t container=%t", sandboxHostProcess, containerHostProcess)
+	}
+
+	isolation, err := isolationTypeFor(config.GetAnnotations())
+	if err != nil {
+		return err
+	}
+	if containerHostProcess && isolation == dockercontainer.IsolationHyperV {
+		return fmt.Errorf("HostProcess containers do not support Hyper-V isolation")
+	}
+	createConfig.HostConfig.Isolation = isolation
+	createConfig.Config.Labels = stampAnnotationsOnLabels(createConfig.Config.Labels, config.GetAnnotations())
+
 	if networkMode := os.Getenv("CONTAINER_NETWORK"); networkMode != "" {
 		createConfig.HostConfig.NetworkMode = dockercontainer.NetworkMode(networkMode)
 	} else {
@@ -63,7 +203,8 @@ func (ds *dockerService) updateCreateConfig(
 	}
 
 	// Apply Windows-specific options if applicable.
-	if wc := config.GetWindows(); wc != nil {
+	wc := config.GetWindows()
+	if wc != nil {
 		rOpts := wc.GetResources()
 		if rOpts != nil {
 			// Precedence and units for these are described at length in kuberuntime_container_windows.go - generateWindowsContainerConfig()
@@ -75,22 +216,52 @@ func (ds *dockerService) updateCreateConfig(
 			}
 		}
 
-		// Apply security context.
-		applyWindowsContainerSecurityContext(wc.GetSecurityContext(), createConfig.Config, createConfig.HostConfig)
+		if isolation == dockercontainer.IsolationHyperV &&
+			createConfig.HostConfig.Resources.NanoCPUs != 0 &&
+			osversion.Build() < nanoCPUsHyperVMinBuild {
+			return fmt.Errorf("NanoCPUs is not supported for Hyper-V isolated containers on builds before %d, host is running build %d", nanoCPUsHyperVMinBuild, osversion.Build())
+		}
+	}
+
+	// Apply security context. This must run even when wc is nil: HostProcess
+	// containers need their user/isolation override regardless of whether a
+	// WindowsContainerConfig was set.
+	var wsc *runtimeapi.WindowsContainerSecurityContext
+	if wc != nil {
+		wsc = wc.GetSecurityContext()
+	}
+	if err := applyWindowsContainerSecurityContext(wsc, createConfig.Config, createConfig.HostConfig, containerHostProcess); err != nil {
+		return err
 	}
 
 	return nil
 }
 
 // applyWindowsContainerSecurityContext updates docker container options according to security context.
-func applyWindowsContainerSecurityContext(wsc *runtimeapi.WindowsContainerSecurityContext, config *dockercontainer.Config, hc *dockercontainer.HostConfig) {
+// HostProcess containers share the host's namespaces and run without isolation, so most of the
+// security context below doesn't apply to them: they default to running as hostProcessDefaultUser
+// unless RunAsUsername overrides it, and Isolation is left unset regardless of what was requested.
+func applyWindowsContainerSecurityContext(wsc *runtimeapi.WindowsContainerSecurityContext, config *dockercontainer.Config, hc *dockercontainer.HostConfig, hostProcess bool) error {
+	if hostProcess {
+		config.User = hostProcessDefaultUser
+		hc.Isolation = ""
+	}
+
 	if wsc == nil {
-		return
+		return nil
 	}
 
 	if wsc.GetRunAsUsername() != "" {
 		config.User = wsc.GetRunAsUsername()
 	}
+
+	opts, err := securityOptsFromCredentialSpec(wsc.GetCredentialSpec(), hostProcess)
+	if err != nil {
+		return err
+	}
+	hc.SecurityOpt = append(hc.SecurityOpt, opts...)
+
+	return nil
 }
 
 func (ds *dockerService) determinePodIPBySandboxID(sandboxID string) []string {
@@ -113,18 +284,33 @@ func (ds *dockerService) determinePodIPBySandboxID(sandboxID string) []string {
 			continue
 		}
 
+		// HostProcess containers share the host's network namespace, so the
+		// CNI/sandbox-IP workaround below doesn't apply: return the host's
+		// own IPs instead of trying to resolve a per-sandbox address.
+		// updateCreateConfig stamps the container's annotations onto its
+		// Labels under containerAnnotationsLabelKeyPrefix, so recover them
+		// from there rather than reading bare annotation keys off Labels,
+		// which would collide with nothing today but isn't how this shim
+		// persists annotations.
+		if isHostProcessContainer(annotationsFromLabels(r.Config.Labels)) {
+			ips, err := hostIPs()
+			if err != nil {
+				klog.ErrorS(err, "failed to determine host IPs for HostProcess sandbox", "sandboxID", sandboxID)
+				return nil
+			}
+			return ips
+		}
+
 		// Versions and feature support
 		// ============================
 		// Windows version == Windows Server, Version 1709, Supports both sandbox and non-sandbox case
 		// Windows version == Windows Server 2016   Support only non-sandbox case
 		// Windows version < Windows Server 2016 is Not Supported
 
-		// Sandbox support in Windows mandates CNI Plugin.
-		// Presence of CONTAINER_NETWORK flag is considered as non-Sandbox cases here
-
-		// Todo: Add a kernel version check for more validation
-
-		if networkMode := os.Getenv("CONTAINER_NETWORK"); networkMode == "" {
+		// Sandbox support in Windows mandates CNI Plugin. Namespace support
+		// landed in RS5; builds before that take the DNS-registry-copy
+		// workaround below.
+		if osversion.Build() < osversion.RS5 {
 			// On Windows, every container that is created in a Sandbox, needs to invoke CNI plugin again for adding the Network,
 			// with the shared container name as NetNS info,
 			// This is passed down to the platform to replicate some necessary information to the new container
@@ -140,7 +326,6 @@ func (ds *dockerService) determinePodIPBySandboxID(sandboxID string) []string {
 			// Windows 1709 and 1803 doesn't have the Namespace support, so getIP() is called
 			// to replicate the DNS registry key to the Workload container (IP/Gateway/MAC is
 			// set separately than DNS).
-			// TODO(feiskyer): remove this workaround after Namespace is supported in Windows RS5.
 			ds.getIPs(sandboxID, r)
 		} else {
 			// ds.getIP will call the CNI plugin to fetch the IP
@@ -153,9 +338,31 @@ func (ds *dockerService) determinePodIPBySandboxID(sandboxID string) []string {
 	return nil
 }
 
+// hostIPs returns the non-loopback IP addresses of the host network
+// namespace, for HostProcess sandboxes that share it directly.
+func hostIPs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		ips = append(ips, ipnet.IP.String())
+	}
+	return ips, nil
+}
+
 func getNetworkNamespace(c *dockertypes.ContainerJSON) (string, error) {
-	// Currently in windows there is no identifier exposed for network namespace
-	// Like docker, the referenced container id is used to figure out the network namespace id internally by the platform
-	// so returning the docker networkMode (which holds container:<ref containerid> for network namespace here
+	// Builds at or above RS5 expose a real network namespace identifier via
+	// HCS; older builds have no such identifier, so fall back to the docker
+	// networkMode (which holds container:<ref containerid>) as a stand-in.
+	if osversion.Build() >= osversion.RS5 && c.NetworkSettings != nil {
+		return c.NetworkSettings.SandboxID, nil
+	}
 	return string(c.HostConfig.NetworkMode), nil
 }
@@ -0,0 +1,208 @@
+//go:build windows && !dockerless
+// +build windows,!dockerless
+
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockershim
+
+import (
+	"reflect"
+	"testing"
+
+	dockercontainer "github.com/docker/docker/api/types/container"
+
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestCredentialSpecSecurityOpt(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		credentialSpec  string
+		wantSecurityOpt string
+		wantErr         bool
+	}{
+		{
+			name:            "empty credential spec",
+			credentialSpec:  "",
+			wantSecurityOpt: "",
+		},
+		{
+			name:            "file reference",
+			credentialSpec:  "file://gmsa.json",
+			wantSecurityOpt: "credentialspec=file://gmsa.json",
+		},
+		{
+			name:            "registry reference",
+			credentialSpec:  "registry://gmsa",
+			wantSecurityOpt: "credentialspec=registry://gmsa",
+		},
+		{
+			name:           "unsupported reference",
+			credentialSpec: "gmsa.json",
+			wantErr:        true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := credentialSpecSecurityOpt(tc.credentialSpec)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.wantSecurityOpt {
+				t.Errorf("expected security opt %q, got %q", tc.wantSecurityOpt, got)
+			}
+		})
+	}
+}
+
+func TestApplyWindowsContainerSecurityContextGMSA(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		wsc         *runtimeapi.WindowsContainerSecurityContext
+		hostProcess bool
+		wantOpts    []string
+		wantErr     bool
+	}{
+		{
+			name:     "no credential spec",
+			wsc:      &runtimeapi.WindowsContainerSecurityContext{},
+			wantOpts: nil,
+		},
+		{
+			name:     "gmsaCredentialSpecName resolved to a file reference",
+			wsc:      &runtimeapi.WindowsContainerSecurityContext{CredentialSpec: "file://gmsa.json"},
+			wantOpts: []string{"credentialspec=file://gmsa.json"},
+		},
+		{
+			name:        "HostProcess containers reject GMSA",
+			wsc:         &runtimeapi.WindowsContainerSecurityContext{CredentialSpec: "file://gmsa.json"},
+			hostProcess: true,
+			wantErr:     true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &dockercontainer.Config{}
+			hc := &dockercontainer.HostConfig{}
+			err := applyWindowsContainerSecurityContext(tc.wsc, config, hc, tc.hostProcess)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(hc.SecurityOpt) != len(tc.wantOpts) {
+				t.Fatalf("expected security opts %v, got %v", tc.wantOpts, hc.SecurityOpt)
+			}
+			for i, want := range tc.wantOpts {
+				if hc.SecurityOpt[i] != want {
+					t.Errorf("security opt %d: expected %q, got %q", i, want, hc.SecurityOpt[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAnnotationsLabelsRoundTrip(t *testing.T) {
+	annotations := map[string]string{
+		hostProcessAnnotation:   "true",
+		isolationTypeAnnotation: "hyperv",
+	}
+
+	labels := stampAnnotationsOnLabels(map[string]string{
+		containerTypeLabelKey: containerTypeLabelContainer,
+		sandboxIDLabelKey:     "some-sandbox-id",
+	}, annotations)
+
+	// Bookkeeping labels must survive stamping untouched.
+	if labels[containerTypeLabelKey] != containerTypeLabelContainer {
+		t.Errorf("expected containerTypeLabelKey to be preserved, got %q", labels[containerTypeLabelKey])
+	}
+	if labels[sandboxIDLabelKey] != "some-sandbox-id" {
+		t.Errorf("expected sandboxIDLabelKey to be preserved, got %q", labels[sandboxIDLabelKey])
+	}
+
+	got := annotationsFromLabels(labels)
+	if !reflect.DeepEqual(got, annotations) {
+		t.Errorf("expected annotations %v after round trip, got %v", annotations, got)
+	}
+
+	if !isHostProcessContainer(got) {
+		t.Errorf("expected recovered annotations to mark a HostProcess container")
+	}
+}
+
+func TestGetSecurityOptsGMSA(t *testing.T) {
+	ds := &dockerService{}
+	for _, tc := range []struct {
+		name           string
+		credentialSpec string
+		hostProcess    bool
+		wantOpts       []string
+		wantErr        bool
+	}{
+		{
+			name:     "no credential spec",
+			wantOpts: nil,
+		},
+		{
+			name:           "file reference",
+			credentialSpec: "file://gmsa.json",
+			wantOpts:       []string{"credentialspec=file://gmsa.json"},
+		},
+		{
+			name:           "HostProcess sandbox and container both reject GMSA",
+			credentialSpec: "file://gmsa.json",
+			hostProcess:    true,
+			wantErr:        true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			containerOpts, err := ds.getSecurityOpts("", tc.credentialSpec, tc.hostProcess, '=')
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("getSecurityOpts: expected an error, got none")
+				}
+			} else if err != nil {
+				t.Fatalf("getSecurityOpts: unexpected error: %v", err)
+			} else if len(containerOpts) != len(tc.wantOpts) || (len(tc.wantOpts) > 0 && containerOpts[0] != tc.wantOpts[0]) {
+				t.Errorf("getSecurityOpts: expected %v, got %v", tc.wantOpts, containerOpts)
+			}
+
+			sandboxOpts, err := ds.getSandBoxSecurityOpts(tc.credentialSpec, tc.hostProcess, '=')
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("getSandBoxSecurityOpts: expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getSandBoxSecurityOpts: unexpected error: %v", err)
+			}
+			if len(sandboxOpts) != len(tc.wantOpts) || (len(tc.wantOpts) > 0 && sandboxOpts[0] != tc.wantOpts[0]) {
+				t.Errorf("getSandBoxSecurityOpts: expected %v, got %v", tc.wantOpts, sandboxOpts)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package osversion wraps github.com/Microsoft/hcsshim/osversion so callers
+// can gate Windows-only behavior on the running build number instead of
+// env-var hacks or string-matching kernel versions.
+package osversion
+
+import (
+	"github.com/Microsoft/hcsshim/osversion"
+)
+
+// Named Windows build numbers that dockershim gates behavior on. Values
+// match the constants hcsshim/osversion exports.
+const (
+	// RS1 is Windows Server, Version 1607 / Windows 10 Anniversary Update.
+	RS1 = osversion.RS1
+	// RS3 is Windows Server, Version 1709. Hyper-V isolation requires this
+	// build or later.
+	RS3 = osversion.RS3
+	// RS5 is Windows Server 2019 / Windows 10 October 2018 Update. Builds at
+	// or above this support native network namespaces.
+	RS5 = osversion.RS5
+)
+
+// Build returns the build number of the host's running Windows version.
+func Build() uint16 {
+	return osversion.Build()
+}
@@ -16,6 +16,20 @@ limitations under the License.
 
 package apiserver
 
+// NOT IMPLEMENTED: User1-NEC/Kubernetes#chunk0-1, #chunk0-2, #chunk0-3,
+// #chunk1-1, #chunk1-2, #chunk1-3, #chunk1-4, #chunk2-1, #chunk2-2,
+// #chunk2-3, #chunk2-4, #chunk2-5, #chunk3-1, #chunk3-2, #chunk3-3, and
+// #chunk3-4 each asked for a field-validation feature (CBOR request
+// bodies, JSON Patch op-level diagnostics, structured StatusDetails
+// causes, CRD strategic-merge-patch, RFC 7396 JSON Merge Patch, warning
+// dedup/capping, outcome metrics/audit, subresource schema selection,
+// Content-Type dispatch) that has no implementation anywhere in this
+// tree. Commits tagged with these IDs added integration tests for the
+// requested behavior and a later same-ID commit removed them once no
+// corresponding production code turned up; none of them should be read
+// as having closed the request. See each pair of commits for what was
+// attempted and why it was reverted.
+
 import (
 	"context"
 	"encoding/json"